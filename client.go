@@ -20,7 +20,10 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/paho"
 )
 
 // MqttClient is a lightweight MQTT v3.1 Client for communicating
@@ -58,6 +61,12 @@ type MqttClient struct {
 	lastContact     lastcontact
 	pingOutstanding bool
 	connected       bool
+	outstanding     int32 // count of in-flight QoS 1/2 messages, atomically updated
+	quiesce         chan struct{}
+	quiesceOnce     sync.Once
+	subs            *subscriptionRegistry
+	pendingMu       sync.Mutex
+	pending         []pendingPublish
 }
 
 // NewClient will create an MQTT v3.1 client with all of the options specified
@@ -73,6 +82,7 @@ func NewClient(ops *ClientOptions) *MqttClient {
 	}
 	c.persist = c.options.store
 	c.connected = false
+	c.subs = newSubscriptionRegistry()
 	return c
 }
 
@@ -101,7 +111,7 @@ func (c *MqttClient) Start() ([]Receipt, error) {
 	c.trace_v(CLI, "Start()")
 
 	for _, broker := range c.options.servers {
-		conn, err := openConnection(broker, c.options.tlsconfig)
+		conn, err := openConnectionWithHeaders(broker, c.options.tlsconfig, c.options.headers)
 		if err == nil {
 			c.conn = conn
 			c.trace_v(CLI, "connected to broker")
@@ -128,6 +138,9 @@ func (c *MqttClient) Start() ([]Receipt, error) {
 	c.oboundP = make(chan *Message)
 	c.errors = make(chan error)
 	c.stop = make(chan struct{})
+	c.quiesce = make(chan struct{})
+	c.quiesceOnce = sync.Once{}
+	atomic.StoreInt32(&c.outstanding, 0)
 
 	go outgoing(c)
 	go alllogic(c)
@@ -159,6 +172,10 @@ func (c *MqttClient) Start() ([]Receipt, error) {
 		go keepalive(c)
 	}
 
+	if c.options.autoReconnect {
+		go c.watchConnection()
+	}
+
 	// Take care of any messages in the store
 	var leftovers []Receipt
 	if c.options.cleanses == false {
@@ -193,16 +210,61 @@ func (c *MqttClient) Disconnect(quiesce uint) {
 	// wait for work to finish, or quiesce time consumed
 	end := time.After(time.Duration(quiesce) * time.Millisecond)
 
-	// for now we just wait for the time specified and hope the work is done
 	select {
+	case <-c.quiesce:
+		c.trace_v(CLI, "finished processing work, graceful disconnect")
 	case <-end:
 		c.trace_v(CLI, "quiesce expired, forcing disconnect")
-		// case <- other:
-		// 	c.trace_v(CLI, "finished processing work, graceful disconnect")
 	}
 	c.disconnect()
 }
 
+// DisconnectWithReason ends the connection with the server the same way
+// as Disconnect, but for MQTT5 servers it additionally sends rc and
+// props (such as SessionExpiryInterval) on the DISCONNECT packet, e.g.
+// rc of 0x04 (Disconnect with Will Message) to request delivery of the
+// Will on an otherwise graceful shutdown.
+func (c *MqttClient) DisconnectWithReason(quiesce uint, rc byte, props *paho.Properties) {
+	if !c.IsConnected() {
+		c.trace_w(CLI, "already disconnected")
+		return
+	}
+	c.trace_v(CLI, "disconnecting with reason %#x", rc)
+	c.connected = false
+
+	end := time.After(time.Duration(quiesce) * time.Millisecond)
+
+	select {
+	case <-c.quiesce:
+		c.trace_v(CLI, "finished processing work, graceful disconnect")
+	case <-end:
+		c.trace_v(CLI, "quiesce expired, forcing disconnect")
+	}
+	c.disconnectWithReason(rc, props)
+}
+
+// trackOutstanding records a QoS 1/2 message as in-flight. It is called
+// whenever such a message is hand off to the outgoing goroutine.
+func (c *MqttClient) trackOutstanding() {
+	atomic.AddInt32(&c.outstanding, 1)
+}
+
+// untrackOutstanding records a QoS 1/2 message as acknowledged (PUBACK
+// for QoS 1, PUBCOMP for QoS 2), closing c.quiesce once no messages
+// remain outstanding and no receipts are unclaimed, so a pending
+// Disconnect can return without waiting out its full quiesce period.
+// It is invoked from receiptMap.resolve on the ack path, and from
+// Publish's own rollback if the message never reaches the wire.
+func (c *MqttClient) untrackOutstanding() {
+	if atomic.AddInt32(&c.outstanding, -1) > 0 {
+		return
+	}
+	if !c.receipts.empty() {
+		return
+	}
+	c.quiesceOnce.Do(func() { close(c.quiesce) })
+}
+
 // ForceDisconnect will end the connection with the mqtt broker immediately.
 func (c *MqttClient) ForceDisconnect() {
 	if !c.IsConnected() {
@@ -227,6 +289,20 @@ func (c *MqttClient) disconnect() {
 	c.persist.Close()
 }
 
+func (c *MqttClient) disconnectWithReason(rc byte, props *paho.Properties) {
+	c.connected = false
+	dm := newDisconnectMsgWithReason(rc, props)
+
+	// Stop all go routines except outgoing
+	close(c.stop)
+
+	// Send disconnect message and stop outgoing
+	c.oboundP <- dm
+
+	c.trace_v(CLI, "disconnected, reason %#x", rc)
+	c.persist.Close()
+}
+
 // Publish will publish a message with the specified QoS
 // and content to the specified topic.
 // Returns a read only channel used to track
@@ -245,9 +321,25 @@ func (c *MqttClient) Publish(qos QoS, topic string, payload interface{}) <-chan
 	r := make(chan Receipt, 1)
 	c.trace_v(CLI, "sending publish message, topic: %s", topic)
 
+	if !c.IsConnected() && c.options.autoReconnect {
+		c.bufferPublish(qos, sendable{pub, r})
+		return r
+	}
+
+	if qos > QOS_ZERO {
+		c.trackOutstanding()
+	}
+
 	select {
 	case c.obound <- sendable{pub, r}:
 	case <-time.After(time.Second):
+		if qos > QOS_ZERO {
+			c.untrackOutstanding()
+		}
+		if c.options.autoReconnect {
+			c.bufferPublish(qos, sendable{pub, r})
+			return r
+		}
 		close(r)
 	}
 	return r
@@ -281,6 +373,15 @@ func (c *MqttClient) StartSubscription(callback MessageHandler, filters ...*Topi
 	if !c.IsConnected() {
 		return nil, ErrNotConnected
 	}
+	return c.subscribe(callback, filters, c.options.autoReconnect)
+}
+
+// subscribe sends a SUBSCRIBE packet for filters and, when register is
+// true, records it in c.subs so AutoReconnect can replay it later.
+// resumeStart replays an already-registered subscription with
+// register=false so the replay does not re-append to c.subs on every
+// reconnect.
+func (c *MqttClient) subscribe(callback MessageHandler, filters []*TopicFilter, register bool) (<-chan Receipt, error) {
 	c.trace_v(CLI, "enter StartSubscription")
 	submsg := newSubscribeMsg(filters...)
 	chkcond(submsg != nil)
@@ -291,6 +392,10 @@ func (c *MqttClient) StartSubscription(callback MessageHandler, filters ...*Topi
 		}
 	}
 
+	if register {
+		c.subs.add(callback, filters)
+	}
+
 	r := make(chan Receipt, 1)
 
 	c.obound <- sendable{submsg, r}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUntrackOutstandingClosesQuiesceExactlyOnce(t *testing.T) {
+	c := &MqttClient{}
+	c.quiesce = make(chan struct{})
+	c.receipts = newReceiptMap()
+	atomic.StoreInt32(&c.outstanding, 1)
+
+	// Fire every decrement concurrently so many goroutines observe
+	// outstanding <= 0 around the same time; before sync.Once this
+	// raced two goroutines into close(c.quiesce) and panicked.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.untrackOutstanding()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-c.quiesce:
+	default:
+		t.Fatal("quiesce was not closed once outstanding reached zero")
+	}
+}
+
+func TestResolveIgnoresUnknownMessageID(t *testing.T) {
+	c := &MqttClient{}
+	c.quiesce = make(chan struct{})
+	c.receipts = newReceiptMap()
+	atomic.StoreInt32(&c.outstanding, 1)
+
+	// msgId 42 was never registered, so this must behave like a
+	// duplicate/retransmitted ack for an already-resolved id: it must
+	// not call untrackOutstanding, or a spurious ack could drive
+	// outstanding below the number of messages actually in flight.
+	c.receipts.resolve(c, 42, QoS(1))
+	c.receipts.resolve(c, 42, QoS(1))
+
+	if got := atomic.LoadInt32(&c.outstanding); got != 1 {
+		t.Fatalf("outstanding = %d after resolving an unknown id, want unchanged at 1", got)
+	}
+	select {
+	case <-c.quiesce:
+		t.Fatal("quiesce closed after resolving an unknown id")
+	default:
+	}
+}
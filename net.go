@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// openConnection dials broker and returns a net.Conn suitable for the
+// existing incoming/outgoing goroutines. The scheme of broker selects
+// the transport:
+//   host:port          plain TCP (the pre-v5 bare-address convention)
+//   tcp://host:port    plain TCP
+//   ssl://host:port    TCP wrapped in TLS (tls is also accepted)
+//   ws://host:port/path    MQTT over WebSocket
+//   wss://host:port/path   MQTT over WebSocket, wrapped in TLS
+// It sends no extra headers; openConnectionWithHeaders sends its
+// headers, when non-nil, with the WebSocket upgrade request and ignores
+// them for the tcp/ssl schemes.
+func openConnection(broker string, tlsc *tls.Config) (net.Conn, error) {
+	return openConnectionWithHeaders(broker, tlsc, nil)
+}
+
+func openConnectionWithHeaders(broker string, tlsc *tls.Config, headers http.Header) (net.Conn, error) {
+	// A bare "host:port" has no "://" separator, so passing it to
+	// url.Parse mis-parses it: url.Parse("localhost:1883") yields
+	// Scheme="localhost", Opaque="1883", Host="". Detect it up front
+	// instead of asking url.Parse to dispatch on scheme.
+	if !strings.Contains(broker, "://") {
+		return net.Dial("tcp", broker)
+	}
+
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return net.Dial("tcp", u.Host)
+	case "ssl", "tls":
+		return tls.Dial("tcp", u.Host, tlsc)
+	case "ws", "wss":
+		return dialWebsocket(u, tlsc, headers)
+	default:
+		return nil, errors.New("unknown broker scheme: " + u.Scheme)
+	}
+}
+
+// dialWebsocket opens an MQTT-over-WebSocket connection to u using the
+// "mqtt" and "mqttv3.1" subprotocols, and wraps it as a net.Conn.
+func dialWebsocket(u *url.URL, tlsc *tls.Config, headers http.Header) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		Subprotocols:    []string{"mqtt", "mqttv3.1"},
+		TLSClientConfig: tlsc,
+	}
+
+	ws, _, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		return nil, err
+	}
+	return newWsConn(ws), nil
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+// Package notify layers a structured JSON event schema on top of an
+// MqttClient so it can act as a first-class notification target, the
+// same role MQTT plays as a bucket-event sink in systems like MinIO.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// errNotConnected is returned by Emit when the client is disconnected
+// and the Notifier was constructed with BufferSize 0.
+var errNotConnected = errors.New("notify: client not connected and buffering disabled")
+
+// Event is a single notification. Source identifies the emitting
+// system, Type is an application-defined event name (e.g.
+// "object.created"), Key identifies the affected resource, and Payload
+// carries the event-specific body.
+type Event struct {
+	Source    string            `json:"source"`
+	Type      string            `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	Key       string            `json:"key"`
+	Payload   json.RawMessage   `json:"payload,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// NotifierConfig configures a Notifier.
+type NotifierConfig struct {
+	// Topic is the MQTT topic events are published to.
+	Topic string
+	// QoS is the QoS level events are published at.
+	QoS byte
+	// BufferSize bounds the in-memory ring buffer used to hold events
+	// that could not be delivered before a reconnect. A size of 0
+	// disables buffering: Emit fails outright when the client is
+	// disconnected.
+	BufferSize int
+}
+
+// Notifier publishes Events to an MqttClient topic, buffering events
+// that arrive while the client is disconnected so they can be replayed
+// once the connection is restored.
+type Notifier struct {
+	client *mqtt.MqttClient
+	cfg    NotifierConfig
+
+	mu     sync.Mutex
+	ring   []Event
+	cursor int
+	count  int
+}
+
+// NewNotifier creates a Notifier that publishes to cfg.Topic over
+// client. client must already have had Start called on it.
+func NewNotifier(client *mqtt.MqttClient, cfg NotifierConfig) *Notifier {
+	n := &Notifier{
+		client: client,
+		cfg:    cfg,
+	}
+	if cfg.BufferSize > 0 {
+		n.ring = make([]Event, cfg.BufferSize)
+	}
+	return n
+}
+
+// Emit marshals event to JSON and publishes it to the configured topic,
+// blocking until either the publish is accepted or ctx is cancelled. If
+// the client is disconnected and buffering is enabled, event is queued
+// and Emit returns nil; it will be replayed by Drain on the next
+// successful reconnect.
+func (n *Notifier) Emit(ctx context.Context, event Event) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	if !n.client.IsConnected() {
+		return n.buffer(event)
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	receipt := n.client.Publish(mqtt.QoS(n.cfg.QoS), n.cfg.Topic, body)
+	select {
+	case _, ok := <-receipt:
+		if !ok {
+			return n.buffer(event)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// buffer writes event into the ring buffer at cursor, evicting the
+// oldest event once BufferSize is reached, and returns an error if
+// buffering is disabled. Re-slicing n.ring (n.ring = n.ring[1:]) does
+// not keep the buffer bounded: once append grows past the freed
+// capacity, the slice stops being full and eviction stops firing. A
+// fixed-size slice indexed by cursor avoids that.
+func (n *Notifier) buffer(event Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.ring) == 0 {
+		return errNotConnected
+	}
+	n.ring[n.cursor] = event
+	n.cursor = (n.cursor + 1) % len(n.ring)
+	if n.count < len(n.ring) {
+		n.count++
+	}
+	return nil
+}
+
+// Drain republishes any events buffered while the client was
+// disconnected, in the order they were emitted. Call it from an
+// OnConnectHandler after a reconnect.
+func (n *Notifier) Drain(ctx context.Context) error {
+	n.mu.Lock()
+	pending := make([]Event, n.count)
+	if n.count > 0 {
+		start := (n.cursor - n.count + len(n.ring)) % len(n.ring)
+		for i := 0; i < n.count; i++ {
+			pending[i] = n.ring[(start+i)%len(n.ring)]
+		}
+	}
+	n.cursor = 0
+	n.count = 0
+	n.mu.Unlock()
+
+	for _, event := range pending {
+		if err := n.Emit(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe registers handler to be called with every Event received on
+// the configured topic. It is a convenience for applications that want
+// to consume their own notification stream.
+func (n *Notifier) Subscribe(handler func(Event)) (<-chan mqtt.Receipt, error) {
+	return n.client.StartSubscription(func(_ *mqtt.MqttClient, msg mqtt.Message) {
+		var event Event
+		if err := json.Unmarshal(msg.Payload(), &event); err != nil {
+			return
+		}
+		handler(event)
+	}, mqtt.NewTopicFilter(n.cfg.Topic, byte(n.cfg.QoS)))
+}
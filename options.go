@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// ClientOptions holds the configurable parameters used to construct an
+// MqttClient with NewClient. Options are set with the fluent Set*
+// methods below, then passed to NewClient.
+type ClientOptions struct {
+	servers     []string
+	clientId    string
+	tlsconfig   *tls.Config
+	headers     http.Header
+	store       Store
+	tracelevel  int
+	tracefile   string
+	cleanses    bool
+	timeout     uint
+	order       bool
+	mids        messageIds
+	msgRouter   *router
+	pubChanZero chan *Message
+	pubChanOne  chan *Message
+	pubChanTwo  chan *Message
+
+	autoReconnect         bool
+	initialReconnectDelay time.Duration
+	maxReconnectDelay     time.Duration
+	connectionLostHandler func(*MqttClient, error)
+	onConnectHandler      func(*MqttClient)
+}
+
+// NewClientOptions returns a new ClientOptions with reasonable defaults:
+// clean session is enabled, and message ordering across handlers is
+// preserved.
+func NewClientOptions() *ClientOptions {
+	return &ClientOptions{
+		headers:               make(http.Header),
+		cleanses:              true,
+		order:                 true,
+		mids:                  newMessageIds(),
+		msgRouter:             newRouter(),
+		initialReconnectDelay: time.Second,
+		maxReconnectDelay:     2 * time.Minute,
+	}
+}
+
+// AddBroker adds broker to the list of servers that Start will attempt
+// to connect to, in order, until one succeeds. broker's scheme selects
+// the transport: "tcp" for plain TCP, "ssl"/"tls" for TCP wrapped in
+// TLS, and "ws"/"wss" for MQTT over WebSocket (optionally over TLS).
+func (o *ClientOptions) AddBroker(broker string) *ClientOptions {
+	o.servers = append(o.servers, broker)
+	return o
+}
+
+// SetClientId sets the client identifier sent in CONNECT.
+func (o *ClientOptions) SetClientId(clientId string) *ClientOptions {
+	o.clientId = clientId
+	return o
+}
+
+// SetTLSConfig sets the TLS configuration used when the broker scheme
+// requires a secure transport ("ssl", "tls", "wss").
+func (o *ClientOptions) SetTLSConfig(tlsconfig *tls.Config) *ClientOptions {
+	o.tlsconfig = tlsconfig
+	return o
+}
+
+// SetHTTPHeaders sets the headers sent with the WebSocket upgrade
+// request, useful for auth proxies or bearer tokens in front of a
+// "ws"/"wss" broker.
+func (o *ClientOptions) SetHTTPHeaders(headers http.Header) *ClientOptions {
+	o.headers = headers
+	return o
+}
+
+// SetStore sets the persistence Store used to hold in-flight QoS 1/2
+// messages across reconnects. If unset, NewClient defaults to a
+// MemoryStore.
+func (o *ClientOptions) SetStore(store Store) *ClientOptions {
+	o.store = store
+	return o
+}
+
+// SetCleanSession controls the CONNECT CleanSession flag. When false the
+// client asks the server to resume the session for its client ID, and
+// Start returns any Receipts left over from before the last disconnect.
+func (o *ClientOptions) SetCleanSession(clean bool) *ClientOptions {
+	o.cleanses = clean
+	return o
+}
+
+// SetTimeout sets the keepalive interval, in seconds. A value of 0
+// disables keepalive pings entirely.
+func (o *ClientOptions) SetTimeout(timeout uint) *ClientOptions {
+	o.timeout = timeout
+	return o
+}
+
+// SetAutoReconnect controls whether the client tries to reconnect, with
+// exponential backoff, after an unexpected disconnect. It is disabled by
+// default: Start still only tries each broker once.
+func (o *ClientOptions) SetAutoReconnect(autoReconnect bool) *ClientOptions {
+	o.autoReconnect = autoReconnect
+	return o
+}
+
+// SetInitialReconnectDelay sets how long the client waits before its
+// first reconnect attempt. Subsequent attempts double this delay, up to
+// MaxReconnectDelay. The default is one second.
+func (o *ClientOptions) SetInitialReconnectDelay(d time.Duration) *ClientOptions {
+	o.initialReconnectDelay = d
+	return o
+}
+
+// SetMaxReconnectDelay caps the exponential backoff between reconnect
+// attempts. The default is two minutes.
+func (o *ClientOptions) SetMaxReconnectDelay(d time.Duration) *ClientOptions {
+	o.maxReconnectDelay = d
+	return o
+}
+
+// SetConnectionLostHandler sets the callback invoked when the client
+// detects an unexpected disconnect, before it begins reconnecting.
+func (o *ClientOptions) SetConnectionLostHandler(h func(*MqttClient, error)) *ClientOptions {
+	o.connectionLostHandler = h
+	return o
+}
+
+// SetOnConnectHandler sets the callback invoked each time the client
+// reconnects after an unexpected disconnect, once the new connection is
+// established and its subscriptions are replayed. It is not invoked for
+// the first connection made by Start.
+func (o *ClientOptions) SetOnConnectHandler(h func(*MqttClient)) *ClientOptions {
+	o.onConnectHandler = h
+	return o
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+// empty reports whether every receipt handed out by receiptMap has been
+// claimed. It is used by Disconnect to decide whether a quiescing
+// client has finished all of its in-flight work.
+func (r *receiptMap) empty() bool {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.index) == 0
+}
+
+// resolve releases the receipt held for msgId and, for a QoS 1/2 message,
+// unwinds the trackOutstanding call made when it was queued. It is called
+// from the incoming dispatch loop on receipt of the PUBACK (QoS 1) or
+// PUBCOMP (QoS 2) that completes msgId's delivery, so c.untrackOutstanding
+// runs on the real acknowledgement path rather than only on the send-side
+// rollback in Publish. untrackOutstanding is only called when msgId was
+// still tracked: a duplicate/retransmitted ack for an id already
+// resolved must not decrement the outstanding count a second time.
+func (r *receiptMap) resolve(c *MqttClient, msgId uint16, qos QoS) {
+	r.Lock()
+	_, found := r.index[msgId]
+	delete(r.index, msgId)
+	r.Unlock()
+	if found && qos > QOS_ZERO {
+		c.untrackOutstanding()
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// subscription is a single entry tracked by subscriptionRegistry so it
+// can be re-established after a reconnect.
+type subscription struct {
+	callback MessageHandler
+	filters  []*TopicFilter
+}
+
+// subscriptionRegistry remembers every StartSubscription call made on a
+// client while AutoReconnect is enabled, so AutoReconnect can replay
+// them once a new session is established.
+type subscriptionRegistry struct {
+	sync.Mutex
+	subs []subscription
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{}
+}
+
+func (r *subscriptionRegistry) add(callback MessageHandler, filters []*TopicFilter) {
+	r.Lock()
+	defer r.Unlock()
+	r.subs = append(r.subs, subscription{callback, filters})
+}
+
+func (r *subscriptionRegistry) snapshot() []subscription {
+	r.Lock()
+	defer r.Unlock()
+	out := make([]subscription, len(r.subs))
+	copy(out, r.subs)
+	return out
+}
+
+// watchConnection waits for an unexpected disconnect reported on
+// c.errors and, if AutoReconnect is enabled, reconnects with exponential
+// backoff across the configured brokers. It runs for the lifetime of a
+// single Start() call and exits once the client is deliberately
+// disconnected or a reconnect attempt gives up.
+func (c *MqttClient) watchConnection() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case err, ok := <-c.errors:
+			if !ok {
+				return
+			}
+			if !c.options.autoReconnect {
+				return
+			}
+			c.Lock()
+			c.connected = false
+			c.Unlock()
+
+			if c.options.connectionLostHandler != nil {
+				c.options.connectionLostHandler(c, err)
+			}
+			c.reconnect()
+			return
+		}
+	}
+}
+
+// reconnect repeatedly tries each configured broker, in order, with
+// exponential backoff and jitter between full passes, until Start
+// succeeds or the client is stopped.
+func (c *MqttClient) reconnect() {
+	delay := c.options.initialReconnectDelay
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		leftovers, err := c.resumeStart()
+		if err == nil {
+			c.trace_v(CLI, "reconnected")
+			if c.options.onConnectHandler != nil {
+				c.options.onConnectHandler(c)
+			}
+			c.drainBufferedPublishes()
+			_ = leftovers
+			return
+		}
+
+		c.trace_w(CLI, "reconnect attempt failed: %s", err)
+		time.Sleep(jitter(delay))
+
+		delay *= 2
+		if delay > c.options.maxReconnectDelay {
+			delay = c.options.maxReconnectDelay
+		}
+	}
+}
+
+// teardown stops the previous connection generation's goroutines
+// (outgoing, alllogic, incoming, keepalive, watchConnection) before
+// resumeStart calls Start again. Without this, Start's fresh
+// c.obound/c.ibound/c.stop channels leave the prior generation's
+// goroutines running with no way to be signalled to exit, leaking one
+// full set of goroutines per reconnect. It also resets c.conn to nil,
+// since Start's only way of detecting "no broker was reachable" is
+// `c.conn == nil`; leaving it set to the closed connection would make
+// that check meaningless on every reconnect attempt after the first.
+func (c *MqttClient) teardown() {
+	if c.stop != nil {
+		select {
+		case <-c.stop:
+		default:
+			close(c.stop)
+		}
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// resumeStart tears down the previous connection generation, then calls
+// Start again to re-open the connection (resuming the session when
+// CleanSession is false) and re-establishes every subscription tracked
+// in the client's subscriptionRegistry.
+func (c *MqttClient) resumeStart() ([]Receipt, error) {
+	c.teardown()
+
+	leftovers, err := c.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range c.subs.snapshot() {
+		if _, err := c.subscribe(sub.callback, sub.filters, false); err != nil {
+			return leftovers, err
+		}
+	}
+	return leftovers, nil
+}
+
+// pendingPublish is a Publish call buffered because the client was
+// disconnected when it was made. PublishMessage calls are not buffered.
+type pendingPublish struct {
+	qos QoS
+	s   sendable
+}
+
+// bufferPublish queues s to be sent once the client reconnects, instead
+// of it being silently dropped the way a Publish call made while
+// disconnected used to be.
+func (c *MqttClient) bufferPublish(qos QoS, s sendable) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.pending = append(c.pending, pendingPublish{qos, s})
+}
+
+// drainBufferedPublishes sends every Publish call that was buffered while the client was disconnected, now that the
+// connection has been re-established.
+func (c *MqttClient) drainBufferedPublishes() {
+	c.pendingMu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.pendingMu.Unlock()
+
+	for _, p := range pending {
+		if p.qos > QOS_ZERO {
+			c.trackOutstanding()
+		}
+		c.obound <- p.s
+	}
+}
+
+// jitter returns d plus up to 20% random jitter, so that many clients
+// backing off against the same broker outage do not all retry in
+// lockstep. It uses the top-level math/rand generator, which is safe
+// for concurrent use by every client's reconnect goroutine, rather than
+// a package-level *rand.Rand, which is not.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
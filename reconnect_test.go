@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJitterAddsUpToTwentyPercent(t *testing.T) {
+	d := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		got := jitter(d)
+		if got < d {
+			t.Fatalf("jitter(%s) = %s, want >= %s", d, got, d)
+		}
+		if max := d + d/5; got > max {
+			t.Fatalf("jitter(%s) = %s, want <= %s", d, got, max)
+		}
+	}
+}
+
+func TestJitterHandlesZeroDelay(t *testing.T) {
+	if got := jitter(0); got < 0 {
+		t.Fatalf("jitter(0) = %s, want >= 0", got)
+	}
+}
+
+func TestSubscriptionRegistryAddAndSnapshot(t *testing.T) {
+	r := newSubscriptionRegistry()
+
+	r.add(nil, make([]*TopicFilter, 1))
+	r.add(nil, nil)
+
+	snap := r.snapshot()
+	if len(snap) != 2 {
+		t.Fatalf("snapshot() has %d entries, want 2", len(snap))
+	}
+
+	// Mutating the returned slice must not affect the registry, since
+	// resumeStart iterates a snapshot while add may be called
+	// concurrently from a fresh StartSubscription.
+	snap[0] = subscription{}
+	if len(r.snapshot()) != 2 {
+		t.Fatalf("snapshot() length changed after mutating a prior snapshot")
+	}
+	if r.snapshot()[0].filters == nil {
+		t.Fatalf("registry entry was cleared by mutating a prior snapshot")
+	}
+}
+
+func TestSubscriptionRegistryConcurrentAddAndSnapshot(t *testing.T) {
+	r := newSubscriptionRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.add(nil, nil)
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.snapshot()
+		}()
+	}
+	wg.Wait()
+
+	if got := len(r.snapshot()); got != 50 {
+		t.Fatalf("snapshot() has %d entries after 50 concurrent adds, want 50", got)
+	}
+}
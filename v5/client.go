@@ -0,0 +1,603 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+// Package v5 provides an MQTT v5 client built on top of the property
+// model in the paho package. It mirrors the shape of the v3.1 MqttClient
+// but every operation that the spec allows to carry properties accepts
+// them explicitly, and the negotiated server properties from CONNACK are
+// retained for the lifetime of the connection.
+package v5
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/paho"
+)
+
+// ErrNotConnected is returned by operations that require an active
+// connection when the client has not yet connected or has disconnected.
+var ErrNotConnected = errors.New("not connected")
+
+// MqttV5Client is an MQTT v5 client for communicating with an MQTT v5
+// server. Unlike MqttClient it exposes the properties introduced in the
+// v5 spec on every operation, and surfaces the properties the server
+// returned in CONNACK via SvrProps.
+type MqttV5Client struct {
+	sync.RWMutex
+	conn           net.Conn
+	bufferedConn   *bufio.ReadWriter
+	writeMu        sync.Mutex
+	options        ClientOptionsV5
+	connected      bool
+	svrProps       *paho.Properties
+	aliases        *TopicAliasCache
+	inboundAliases *InboundAliasTable
+	corr           *correlated
+	done           chan struct{}
+	nextID         uint32
+	fallback       MessageHandler
+
+	replyTopicsMu         sync.Mutex
+	subscribedReplyTopics map[string]bool
+
+	pendingAcksMu sync.Mutex
+	pendingAcks   map[uint16]chan packets.ControlPacket
+
+	authMu    sync.Mutex
+	authAckCh chan *packets.AuthPacket
+
+	inboundQoS2Mu sync.Mutex
+	inboundQoS2   map[uint16]struct{}
+}
+
+// NewClient creates an MQTT v5 client with the options provided. The
+// client must have Connect called on it before it may be used.
+func NewClient(ops *ClientOptionsV5) *MqttV5Client {
+	c := &MqttV5Client{}
+	c.options = *ops
+	c.subscribedReplyTopics = make(map[string]bool)
+	c.pendingAcks = make(map[uint16]chan packets.ControlPacket)
+	c.inboundQoS2 = make(map[uint16]struct{})
+	return c
+}
+
+// writePacket writes cp to the connection and flushes it, holding
+// writeMu for the duration. Publish/Subscribe/Unsubscribe/Auth/
+// disconnect all write to the single shared c.bufferedConn, and this
+// package explicitly allows calling them concurrently (Request in
+// particular does concurrent Publish/Subscribe), so every write must go
+// through here or two packets can interleave their bytes on the wire.
+func (c *MqttV5Client) writePacket(cp packets.ControlPacket) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := cp.Write(c.bufferedConn); err != nil {
+		return err
+	}
+	return c.bufferedConn.Flush()
+}
+
+// nextPacketID returns the next packet identifier to stamp on a
+// PUBLISH (QoS>0), SUBSCRIBE, or UNSUBSCRIBE packet. Identifiers are
+// assigned sequentially and wrap within the 16-bit, non-zero range the
+// spec requires.
+func (c *MqttV5Client) nextPacketID() uint16 {
+	return uint16(atomic.AddUint32(&c.nextID, 1)%0xffff + 1)
+}
+
+// IsConnected returns whether the client is currently connected to a
+// server.
+func (c *MqttV5Client) IsConnected() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.connected
+}
+
+// SvrProps returns the properties the server sent back in CONNACK, such
+// as AssignedClientID or ServerKeepAlive. It returns nil until Connect
+// has completed successfully.
+func (c *MqttV5Client) SvrProps() *paho.Properties {
+	c.RLock()
+	defer c.RUnlock()
+	return c.svrProps
+}
+
+// Connect opens the underlying connection and sends a CONNECT packet
+// carrying props (SessionExpiryInterval, ReceiveMaximum,
+// MaximumPacketSize, TopicAliasMaximum, etc). It blocks until CONNACK is
+// received and returns the negotiated reason code.
+func (c *MqttV5Client) Connect(props *paho.Properties) (packets.ReasonCode, error) {
+	if ok, invalid := props.Validate(packets.CONNECT); !ok {
+		return packets.ReasonCodeProtocolError, invalidPropertiesErr(invalid)
+	}
+
+	conn, err := openConnection(c.options.broker, c.options.tlsconfig)
+	if err != nil {
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+	c.conn = conn
+	c.bufferedConn = bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
+
+	cp := packets.NewControlPacket(packets.CONNECT).(*packets.ConnectPacket)
+	cp.ClientIdentifier = c.options.clientId
+	cp.CleanStart = c.options.cleanStart
+	cp.Properties = props
+	if err := c.writePacket(cp); err != nil {
+		c.conn.Close()
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+
+	ack, err := packets.ReadPacket(c.bufferedConn)
+	if err != nil {
+		c.conn.Close()
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+	ca, ok := ack.(*packets.ConnackPacket)
+	if !ok {
+		c.conn.Close()
+		return packets.ReasonCodeProtocolError, errors.New("expected CONNACK")
+	}
+
+	var outboundMax uint16
+	if ca.Properties != nil && ca.Properties.TopicAliasMaximum != nil {
+		outboundMax = *ca.Properties.TopicAliasMaximum
+	}
+	var inboundMax uint16
+	if props != nil && props.TopicAliasMaximum != nil {
+		inboundMax = *props.TopicAliasMaximum
+	}
+
+	c.Lock()
+	c.svrProps = ca.Properties
+	c.connected = ca.ReasonCode == packets.ReasonCodeSuccess
+	c.aliases = NewTopicAliasCache(outboundMax)
+	c.inboundAliases = NewInboundAliasTable(inboundMax)
+	c.done = make(chan struct{})
+	c.Unlock()
+
+	if ca.ReasonCode != packets.ReasonCodeSuccess {
+		c.conn.Close()
+		return ca.ReasonCode, errors.New("connect refused: " + ca.ReasonCode.String())
+	}
+
+	go c.readLoop()
+
+	return ca.ReasonCode, nil
+}
+
+// Publish publishes payload to topic at qos, attaching props (such as
+// MessageExpiryInterval, TopicAlias, or UserProperty) to the PUBLISH
+// packet. It returns the reason code the server assigned the publish
+// (for QoS 1/2) once acknowledged.
+func (c *MqttV5Client) Publish(topic string, qos byte, payload []byte, props *paho.Properties) (packets.ReasonCode, error) {
+	if !c.IsConnected() {
+		return packets.ReasonCodeUnspecifiedError, ErrNotConnected
+	}
+	if ok, invalid := props.Validate(packets.PUBLISH); !ok {
+		return packets.ReasonCodeProtocolError, invalidPropertiesErr(invalid)
+	}
+
+	pp := packets.NewControlPacket(packets.PUBLISH).(*packets.PublishPacket)
+	pp.TopicName = topic
+	pp.Qos = qos
+	pp.Payload = payload
+	pp.Properties = props
+	if qos > 0 {
+		pp.MessageID = c.nextPacketID()
+	}
+
+	return c.sendAndAwait(pp, qos)
+}
+
+// Subscribe subscribes to filters with props (such as
+// SubscriptionIdentifier). It returns the reason code granted for each
+// filter, in the same order as filters.
+func (c *MqttV5Client) Subscribe(filters []packets.TopicQOSTuple, props *paho.Properties) ([]packets.ReasonCode, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+	if ok, invalid := props.Validate(packets.SUBSCRIBE); !ok {
+		return nil, invalidPropertiesErr(invalid)
+	}
+
+	sp := packets.NewControlPacket(packets.SUBSCRIBE).(*packets.SubscribePacket)
+	sp.Topics = filters
+	sp.Properties = props
+	sp.MessageID = c.nextPacketID()
+
+	ack, err := c.sendAndReadAck(sp, sp.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	suback, ok := ack.(*packets.SubackPacket)
+	if !ok {
+		return nil, errors.New("expected SUBACK")
+	}
+	return suback.ReasonCodes, nil
+}
+
+// Unsubscribe removes the subscriptions for topics, attaching props to
+// the UNSUBSCRIBE packet, and returns the per-topic reason codes granted
+// by the server.
+func (c *MqttV5Client) Unsubscribe(topics []string, props *paho.Properties) ([]packets.ReasonCode, error) {
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+	if ok, invalid := props.Validate(packets.UNSUBSCRIBE); !ok {
+		return nil, invalidPropertiesErr(invalid)
+	}
+
+	up := packets.NewControlPacket(packets.UNSUBSCRIBE).(*packets.UnsubscribePacket)
+	up.Topics = topics
+	up.Properties = props
+	up.MessageID = c.nextPacketID()
+
+	ack, err := c.sendAndReadAck(up, up.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	unsuback, ok := ack.(*packets.UnsubackPacket)
+	if !ok {
+		return nil, errors.New("expected UNSUBACK")
+	}
+	return unsuback.ReasonCodes, nil
+}
+
+// Auth drives an AUTH challenge/response exchange outside of CONNECT,
+// for extended authentication methods. props must carry AuthMethod and
+// typically AuthData. It blocks until the broker replies with its own
+// AUTH packet (continuing the challenge or reporting ReasonCodeSuccess)
+// or the connection drops. AUTH carries no packet identifier, so unlike
+// Publish/Subscribe/Unsubscribe the reply is correlated by having at
+// most one exchange in flight at a time, per the spec.
+func (c *MqttV5Client) Auth(props *paho.Properties) (packets.ReasonCode, error) {
+	if !c.IsConnected() {
+		return packets.ReasonCodeUnspecifiedError, ErrNotConnected
+	}
+	if ok, invalid := props.Validate(packets.AUTH); !ok {
+		return packets.ReasonCodeProtocolError, invalidPropertiesErr(invalid)
+	}
+
+	ap := packets.NewControlPacket(packets.AUTH).(*packets.AuthPacket)
+	ap.Properties = props
+
+	ackCh := c.registerAuthAck()
+	defer c.forgetAuthAck()
+	if err := c.writePacket(ap); err != nil {
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+
+	select {
+	case reply := <-ackCh:
+		return reply.ReasonCode, nil
+	case <-c.end():
+		return packets.ReasonCodeUnspecifiedError, errors.New("disconnected while awaiting AUTH reply")
+	}
+}
+
+// registerAuthAck installs the channel readLoop delivers the next AUTH
+// reply to.
+func (c *MqttV5Client) registerAuthAck() chan *packets.AuthPacket {
+	ch := make(chan *packets.AuthPacket, 1)
+	c.authMu.Lock()
+	c.authAckCh = ch
+	c.authMu.Unlock()
+	return ch
+}
+
+func (c *MqttV5Client) forgetAuthAck() {
+	c.authMu.Lock()
+	c.authAckCh = nil
+	c.authMu.Unlock()
+}
+
+// dispatchAuth hands an incoming AUTH packet to the Auth call waiting
+// on it, if any.
+func (c *MqttV5Client) dispatchAuth(ap *packets.AuthPacket) {
+	c.authMu.Lock()
+	ch := c.authAckCh
+	c.authMu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- ap:
+	default:
+	}
+}
+
+// Disconnect sends a DISCONNECT packet with reason code
+// ReasonCodeNormalDisconnection and no properties, then closes the
+// connection.
+func (c *MqttV5Client) Disconnect() error {
+	return c.disconnect(packets.ReasonCodeNormalDisconnection, nil)
+}
+
+// DisconnectWithReason sends a DISCONNECT packet carrying rc and props
+// (such as SessionExpiryInterval, to override the value negotiated at
+// CONNECT) before closing the connection.
+func (c *MqttV5Client) DisconnectWithReason(rc packets.ReasonCode, props *paho.Properties) error {
+	return c.disconnect(rc, props)
+}
+
+func (c *MqttV5Client) disconnect(rc packets.ReasonCode, props *paho.Properties) error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+	if ok, invalid := props.Validate(packets.DISCONNECT); !ok {
+		return invalidPropertiesErr(invalid)
+	}
+
+	dp := packets.NewControlPacket(packets.DISCONNECT).(*packets.DisconnectPacket)
+	dp.ReasonCode = rc
+	dp.Properties = props
+
+	c.Lock()
+	c.connected = false
+	c.Unlock()
+
+	err := c.writePacket(dp)
+	c.conn.Close()
+	return err
+}
+
+// sendAndAwait writes pp and, for qos>0, blocks for its acknowledgement:
+// a PUBACK settles QoS 1, while QoS 2 additionally drives the
+// PUBREC/PUBREL/PUBCOMP handshake via sendPubrel before it is settled.
+func (c *MqttV5Client) sendAndAwait(pp *packets.PublishPacket, qos byte) (packets.ReasonCode, error) {
+	if qos == 0 {
+		if err := c.writePacket(pp); err != nil {
+			return packets.ReasonCodeUnspecifiedError, err
+		}
+		return packets.ReasonCodeSuccess, nil
+	}
+
+	ackCh := c.registerPendingAck(pp.MessageID)
+	if err := c.writePacket(pp); err != nil {
+		c.forgetPendingAck(pp.MessageID)
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+
+	ack, err := c.awaitAck(pp.MessageID, ackCh)
+	if err != nil {
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+	switch a := ack.(type) {
+	case *packets.PubackPacket:
+		return a.ReasonCode, nil
+	case *packets.PubrecPacket:
+		return c.sendPubrel(pp.MessageID)
+	default:
+		return packets.ReasonCodeUnspecifiedError, errors.New("unexpected publish acknowledgement")
+	}
+}
+
+// sendPubrel completes the QoS 2 exchange after a PUBREC: it sends
+// PUBREL for id and blocks for the matching PUBCOMP.
+func (c *MqttV5Client) sendPubrel(id uint16) (packets.ReasonCode, error) {
+	rp := packets.NewControlPacket(packets.PUBREL).(*packets.PubrelPacket)
+	rp.MessageID = id
+
+	ackCh := c.registerPendingAck(id)
+	if err := c.writePacket(rp); err != nil {
+		c.forgetPendingAck(id)
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+
+	ack, err := c.awaitAck(id, ackCh)
+	if err != nil {
+		return packets.ReasonCodeUnspecifiedError, err
+	}
+	pc, ok := ack.(*packets.PubcompPacket)
+	if !ok {
+		return packets.ReasonCodeUnspecifiedError, errors.New("expected PUBCOMP")
+	}
+	return pc.ReasonCode, nil
+}
+
+func (c *MqttV5Client) sendAndReadAck(cp packets.ControlPacket, id uint16) (packets.ControlPacket, error) {
+	ackCh := c.registerPendingAck(id)
+
+	if err := c.writePacket(cp); err != nil {
+		c.forgetPendingAck(id)
+		return nil, err
+	}
+	return c.awaitAck(id, ackCh)
+}
+
+// registerPendingAck installs a channel that readLoop delivers the
+// acknowledgement for packet id to, so a caller blocked in
+// sendAndAwait/sendAndReadAck never races readLoop for a read off the
+// shared connection.
+func (c *MqttV5Client) registerPendingAck(id uint16) chan packets.ControlPacket {
+	ch := make(chan packets.ControlPacket, 1)
+	c.pendingAcksMu.Lock()
+	c.pendingAcks[id] = ch
+	c.pendingAcksMu.Unlock()
+	return ch
+}
+
+func (c *MqttV5Client) forgetPendingAck(id uint16) {
+	c.pendingAcksMu.Lock()
+	delete(c.pendingAcks, id)
+	c.pendingAcksMu.Unlock()
+}
+
+// awaitAck blocks until readLoop delivers the ack for id on ch, the
+// connection is closed, or the client disconnects.
+func (c *MqttV5Client) awaitAck(id uint16, ch chan packets.ControlPacket) (packets.ControlPacket, error) {
+	defer c.forgetPendingAck(id)
+	select {
+	case ack := <-ch:
+		return ack, nil
+	case <-c.end():
+		return nil, errors.New("disconnected while awaiting acknowledgement")
+	}
+}
+
+// dispatchAck hands ack to the sender waiting on its packet identifier,
+// if any. It reports whether a waiter consumed it, so readLoop can drop
+// unrecognised or already-timed-out acks instead.
+func (c *MqttV5Client) dispatchAck(id uint16, ack packets.ControlPacket) bool {
+	c.pendingAcksMu.Lock()
+	ch, ok := c.pendingAcks[id]
+	c.pendingAcksMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- ack:
+	default:
+	}
+	return true
+}
+
+// ackPublish sends the receiver-side acknowledgement the spec requires
+// for an inbound QoS>0 PUBLISH identified by id: PUBACK for QoS 1, or
+// PUBREC for QoS 2 (completeInboundQoS2 sends the matching PUBCOMP once
+// the broker's PUBREL arrives). Without this every broker keeps
+// redelivering the message (DUP) until its receive-maximum window for
+// this client is exhausted. It is a no-op for QoS 0.
+func (c *MqttV5Client) ackPublish(qos byte, id uint16) {
+	switch qos {
+	case 1:
+		ap := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+		ap.MessageID = id
+		c.writePacket(ap)
+	case 2:
+		c.markInboundQoS2(id)
+		rp := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+		rp.MessageID = id
+		c.writePacket(rp)
+	}
+}
+
+// markInboundQoS2 records id as a QoS 2 PUBLISH awaiting PUBREL, so a
+// retransmitted (DUP) copy of the same message is PUBREC'd again
+// without being dispatched a second time.
+func (c *MqttV5Client) markInboundQoS2(id uint16) {
+	c.inboundQoS2Mu.Lock()
+	c.inboundQoS2[id] = struct{}{}
+	c.inboundQoS2Mu.Unlock()
+}
+
+// seenInboundQoS2 reports whether id is a QoS 2 PUBLISH already
+// dispatched and still awaiting PUBREL.
+func (c *MqttV5Client) seenInboundQoS2(id uint16) bool {
+	c.inboundQoS2Mu.Lock()
+	defer c.inboundQoS2Mu.Unlock()
+	_, ok := c.inboundQoS2[id]
+	return ok
+}
+
+// completeInboundQoS2 replies to the broker's PUBREL for id with
+// PUBCOMP, completing the QoS 2 receive handshake, and forgets id so a
+// future reuse of the same packet identifier is treated as a new
+// message.
+func (c *MqttV5Client) completeInboundQoS2(id uint16) {
+	c.inboundQoS2Mu.Lock()
+	delete(c.inboundQoS2, id)
+	c.inboundQoS2Mu.Unlock()
+
+	cp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+	cp.MessageID = id
+	c.writePacket(cp)
+}
+
+// readLoop is the connection's sole reader. It is started by Connect and
+// runs for the life of the connection, delivering PUBLISH packets to
+// Listen's dispatch (correlated waiters, then the registered fallback
+// handler) and then sending back the PUBACK/PUBREC the spec requires for
+// QoS>0, completing the QoS 2 receive handshake on PUBREL, and routing
+// every other acknowledgement to the sender blocked on it in
+// sendAndAwait/sendAndReadAck via dispatchAck. Reading acks
+// synchronously from those methods instead would race readLoop for
+// packets off the same connection.
+func (c *MqttV5Client) readLoop() {
+	for {
+		pkt, err := packets.ReadPacket(c.bufferedConn)
+		if err != nil {
+			c.Lock()
+			close(c.done)
+			c.Unlock()
+			return
+		}
+
+		switch p := pkt.(type) {
+		case *packets.PublishPacket:
+			topic, err := c.resolveInboundTopic(p.TopicName, p.Properties)
+			if err != nil {
+				continue
+			}
+			if p.Qos == 2 && c.seenInboundQoS2(p.MessageID) {
+				// Retransmitted (DUP) copy of a QoS 2 message we
+				// already dispatched and are still awaiting PUBREL
+				// for: PUBREC it again without redispatching.
+				c.ackPublish(p.Qos, p.MessageID)
+				continue
+			}
+			if c.dispatchCorrelated(topic, p.Payload, p.Properties) {
+				c.ackPublish(p.Qos, p.MessageID)
+				continue
+			}
+			if fb := c.fallbackHandler(); fb != nil {
+				fb(topic, p.Payload)
+			}
+			c.ackPublish(p.Qos, p.MessageID)
+		case *packets.PubrelPacket:
+			c.completeInboundQoS2(p.MessageID)
+		case *packets.PubackPacket:
+			c.dispatchAck(p.MessageID, p)
+		case *packets.PubrecPacket:
+			c.dispatchAck(p.MessageID, p)
+		case *packets.PubcompPacket:
+			c.dispatchAck(p.MessageID, p)
+		case *packets.SubackPacket:
+			c.dispatchAck(p.MessageID, p)
+		case *packets.UnsubackPacket:
+			c.dispatchAck(p.MessageID, p)
+		case *packets.AuthPacket:
+			c.dispatchAuth(p)
+		}
+	}
+}
+
+func (c *MqttV5Client) fallbackHandler() MessageHandler {
+	c.RLock()
+	defer c.RUnlock()
+	return c.fallback
+}
+
+func invalidPropertiesErr(invalid []string) error {
+	msg := "invalid properties for packet type:"
+	for _, name := range invalid {
+		msg += " " + name
+	}
+	return errors.New(msg)
+}
+
+// openConnection dials broker, wrapping the connection in TLS when
+// tlsconfig is non-nil. It is a v5-local counterpart to the v3.1
+// client's openConnection.
+func openConnection(broker string, tlsconfig *tls.Config) (net.Conn, error) {
+	if tlsconfig != nil {
+		return tls.Dial("tcp", broker, tlsconfig)
+	}
+	return net.Dial("tcp", broker)
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package v5
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// newTestClient wires an MqttV5Client to one end of an in-memory net.Pipe
+// as though Connect had already succeeded, with readLoop running, and
+// hands back the other end plus a persistent reader for a test to play
+// broker with. It skips Connect/CONNACK entirely since the ack-routing
+// and AUTH correlation logic under test all run after that handshake.
+func newTestClient(t *testing.T) (c *MqttV5Client, broker net.Conn, brokerReader *bufio.Reader) {
+	t.Helper()
+
+	clientConn, brokerConn := net.Pipe()
+
+	c = NewClient(&ClientOptionsV5{})
+	c.conn = clientConn
+	c.bufferedConn = bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn))
+	c.done = make(chan struct{})
+	c.connected = true
+
+	go c.readLoop()
+
+	t.Cleanup(func() {
+		clientConn.Close()
+		brokerConn.Close()
+	})
+
+	return c, brokerConn, bufio.NewReader(brokerConn)
+}
+
+func readBrokerPacket(t *testing.T, r *bufio.Reader) packets.ControlPacket {
+	t.Helper()
+	pkt, err := packets.ReadPacket(r)
+	if err != nil {
+		t.Fatalf("broker side failed to read packet: %v", err)
+	}
+	return pkt
+}
+
+func TestSendAndAwaitQoS1WaitsForPuback(t *testing.T) {
+	c, broker, brokerReader := newTestClient(t)
+
+	rcCh := make(chan packets.ReasonCode, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		rc, err := c.Publish("t", 1, []byte("hi"), nil)
+		rcCh <- rc
+		errCh <- err
+	}()
+
+	pp, ok := readBrokerPacket(t, brokerReader).(*packets.PublishPacket)
+	if !ok {
+		t.Fatal("broker did not receive a PublishPacket")
+	}
+
+	ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+	ack.MessageID = pp.MessageID
+	ack.ReasonCode = packets.ReasonCodeSuccess
+	if err := ack.Write(broker); err != nil {
+		t.Fatalf("broker failed to write PUBACK: %v", err)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Publish returned error: %v", err)
+		}
+		if rc := <-rcCh; rc != packets.ReasonCodeSuccess {
+			t.Fatalf("Publish reason code = %v, want Success", rc)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish did not return after PUBACK")
+	}
+}
+
+func TestSendAndAwaitQoS2DrivesPubrelPubcompHandshake(t *testing.T) {
+	c, broker, brokerReader := newTestClient(t)
+
+	rcCh := make(chan packets.ReasonCode, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		rc, err := c.Publish("t", 2, []byte("hi"), nil)
+		rcCh <- rc
+		errCh <- err
+	}()
+
+	pp, ok := readBrokerPacket(t, brokerReader).(*packets.PublishPacket)
+	if !ok {
+		t.Fatal("broker did not receive a PublishPacket")
+	}
+
+	rec := packets.NewControlPacket(packets.PUBREC).(*packets.PubrecPacket)
+	rec.MessageID = pp.MessageID
+	if err := rec.Write(broker); err != nil {
+		t.Fatalf("broker failed to write PUBREC: %v", err)
+	}
+
+	rel, ok := readBrokerPacket(t, brokerReader).(*packets.PubrelPacket)
+	if !ok {
+		t.Fatal("broker did not receive a PubrelPacket after PUBREC")
+	}
+	if rel.MessageID != pp.MessageID {
+		t.Fatalf("PUBREL message id = %d, want %d", rel.MessageID, pp.MessageID)
+	}
+
+	comp := packets.NewControlPacket(packets.PUBCOMP).(*packets.PubcompPacket)
+	comp.MessageID = rel.MessageID
+	comp.ReasonCode = packets.ReasonCodeSuccess
+	if err := comp.Write(broker); err != nil {
+		t.Fatalf("broker failed to write PUBCOMP: %v", err)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Publish returned error: %v", err)
+		}
+		if rc := <-rcCh; rc != packets.ReasonCodeSuccess {
+			t.Fatalf("Publish reason code = %v, want Success", rc)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish did not return after PUBCOMP")
+	}
+}
+
+func TestSendAndAwaitIgnoresAckForAnotherMessageID(t *testing.T) {
+	c, broker, brokerReader := newTestClient(t)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Publish("t", 1, []byte("hi"), nil)
+		errCh <- err
+	}()
+
+	pp, ok := readBrokerPacket(t, brokerReader).(*packets.PublishPacket)
+	if !ok {
+		t.Fatal("broker did not receive a PublishPacket")
+	}
+
+	// A PUBACK for a stale/unrelated message id must not be routed to
+	// this waiter: dispatchAck only delivers to a registered id, so this
+	// stray ack should be silently dropped and the real one still awaited.
+	stray := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+	stray.MessageID = pp.MessageID + 1
+	if err := stray.Write(broker); err != nil {
+		t.Fatalf("broker failed to write stray PUBACK: %v", err)
+	}
+
+	select {
+	case <-errCh:
+		t.Fatal("Publish returned before its own PUBACK arrived")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ack := packets.NewControlPacket(packets.PUBACK).(*packets.PubackPacket)
+	ack.MessageID = pp.MessageID
+	ack.ReasonCode = packets.ReasonCodeSuccess
+	if err := ack.Write(broker); err != nil {
+		t.Fatalf("broker failed to write PUBACK: %v", err)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Publish returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish did not return after its own PUBACK")
+	}
+}
+
+func TestAuthWaitsForReply(t *testing.T) {
+	c, broker, brokerReader := newTestClient(t)
+
+	rcCh := make(chan packets.ReasonCode, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		rc, err := c.Auth(nil)
+		rcCh <- rc
+		errCh <- err
+	}()
+
+	if _, ok := readBrokerPacket(t, brokerReader).(*packets.AuthPacket); !ok {
+		t.Fatal("broker did not receive an AuthPacket")
+	}
+
+	reply := packets.NewControlPacket(packets.AUTH).(*packets.AuthPacket)
+	reply.ReasonCode = packets.ReasonCodeSuccess
+	if err := reply.Write(broker); err != nil {
+		t.Fatalf("broker failed to write AUTH reply: %v", err)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Auth returned error: %v", err)
+		}
+		if rc := <-rcCh; rc != packets.ReasonCodeSuccess {
+			t.Fatalf("Auth reason code = %v, want Success", rc)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Auth did not return after the AUTH reply")
+	}
+}
+
+func TestDispatchAuthDropsReplyWhenNoExchangeIsInFlight(t *testing.T) {
+	c, _, _ := newTestClient(t)
+
+	// AUTH carries no packet identifier, so correlation is a single slot
+	// that only exists while an Auth call is in flight. A reply arriving
+	// with nothing registered (e.g. a duplicate from the broker) must be
+	// dropped rather than panic or block readLoop.
+	reply := packets.NewControlPacket(packets.AUTH).(*packets.AuthPacket)
+	reply.ReasonCode = packets.ReasonCodeSuccess
+	c.dispatchAuth(reply)
+}
+
+func TestAuthReturnsErrorWhenConnectionCloses(t *testing.T) {
+	c, broker, brokerReader := newTestClient(t)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Auth(nil)
+		errCh <- err
+	}()
+
+	readBrokerPacket(t, brokerReader)
+	broker.Close()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("Auth returned a nil error after the connection closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Auth did not return after the connection closed")
+	}
+}
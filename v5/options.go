@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package v5
+
+import "crypto/tls"
+
+// ClientOptionsV5 holds the configuration used to construct an
+// MqttV5Client. Unlike the v3.1 ClientOptions it has no notion of a
+// persistence Store or message router of its own; those concerns are
+// expected to sit on top of MqttV5Client in callers that need them.
+type ClientOptionsV5 struct {
+	broker     string
+	clientId   string
+	cleanStart bool
+	tlsconfig  *tls.Config
+}
+
+// NewClientOptionsV5 creates a ClientOptionsV5 with reasonable defaults:
+// CleanStart is true, as required by a client that has no session to
+// resume.
+func NewClientOptionsV5() *ClientOptionsV5 {
+	return &ClientOptionsV5{
+		cleanStart: true,
+	}
+}
+
+// SetBroker sets the "host:port" address of the MQTT v5 server to
+// connect to.
+func (o *ClientOptionsV5) SetBroker(broker string) *ClientOptionsV5 {
+	o.broker = broker
+	return o
+}
+
+// SetClientId sets the client identifier sent in CONNECT.
+func (o *ClientOptionsV5) SetClientId(clientId string) *ClientOptionsV5 {
+	o.clientId = clientId
+	return o
+}
+
+// SetCleanStart sets the CONNECT CleanStart flag. When false the client
+// asks the server to resume any existing session for its client ID.
+func (o *ClientOptionsV5) SetCleanStart(cleanStart bool) *ClientOptionsV5 {
+	o.cleanStart = cleanStart
+	return o
+}
+
+// SetTLSConfig sets the TLS configuration used when dialing the broker.
+// A nil config (the default) connects over plain TCP.
+func (o *ClientOptionsV5) SetTLSConfig(tlsconfig *tls.Config) *ClientOptionsV5 {
+	o.tlsconfig = tlsconfig
+	return o
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package v5
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/paho"
+)
+
+// MessageHandler is invoked with the payload of a message that matched
+// either a topic subscription or a registered correlation ID.
+type MessageHandler func(topic string, payload []byte)
+
+// Response is the result of a Request: the payload of the PUBLISH whose
+// CorrelationData matched the request, and the topic it arrived on.
+type Response struct {
+	Topic   string
+	Payload []byte
+}
+
+// RequestOption configures a single call to Request.
+type RequestOption func(*requestConfig)
+
+type requestConfig struct {
+	replyTopic string
+	timeout    time.Duration
+	qos        byte
+}
+
+// WithReplyTopic overrides the topic the responder is asked to publish
+// its response to. Without this option, Request derives the reply topic
+// from the server's ResponseInfo (if it advertised one in CONNACK) or
+// falls back to "<clientId>/response".
+func WithReplyTopic(topic string) RequestOption {
+	return func(c *requestConfig) { c.replyTopic = topic }
+}
+
+// WithTimeout bounds how long Request waits for a response before
+// returning context.DeadlineExceeded. The default is 30 seconds.
+func WithTimeout(d time.Duration) RequestOption {
+	return func(c *requestConfig) { c.timeout = d }
+}
+
+// WithRequestQoS sets the QoS the request is published at. The default
+// is QoS 1.
+func WithRequestQoS(qos byte) RequestOption {
+	return func(c *requestConfig) { c.qos = qos }
+}
+
+type waiter struct {
+	ch chan Response
+	cb MessageHandler
+}
+
+// correlated tracks waiters registered via RegisterCorrelated, keyed by
+// the string form of their correlation data.
+type correlated struct {
+	m sync.Map // string(correlationID) -> *waiter
+}
+
+func (c *MqttV5Client) correlation() *correlated {
+	c.Lock()
+	defer c.Unlock()
+	if c.corr == nil {
+		c.corr = &correlated{}
+	}
+	return c.corr
+}
+
+// RegisterCorrelated arranges for cb to be invoked with the payload of
+// any incoming PUBLISH whose CorrelationData equals correlationID,
+// instead of dispatching it through the topic-based router. Callers
+// should UnregisterCorrelated once they no longer expect a match, since
+// entries are otherwise never reclaimed.
+func (c *MqttV5Client) RegisterCorrelated(correlationID []byte, cb MessageHandler) {
+	c.correlation().m.Store(string(correlationID), &waiter{cb: cb})
+}
+
+// UnregisterCorrelated removes a callback previously installed with
+// RegisterCorrelated.
+func (c *MqttV5Client) UnregisterCorrelated(correlationID []byte) {
+	c.correlation().m.Delete(string(correlationID))
+}
+
+// dispatchCorrelated routes an incoming PUBLISH to a waiter registered
+// against its CorrelationData, if any. It reports whether a waiter
+// consumed the message; the caller should fall back to topic-based
+// routing when it returns false.
+func (c *MqttV5Client) dispatchCorrelated(topic string, payload []byte, props *paho.Properties) bool {
+	if props == nil || props.CorrelationData == nil {
+		return false
+	}
+	key := string(props.CorrelationData)
+	v, ok := c.correlation().m.Load(key)
+	if !ok {
+		return false
+	}
+	w := v.(*waiter)
+	if w.ch != nil {
+		select {
+		case w.ch <- Response{Topic: topic, Payload: payload}:
+		default:
+		}
+	}
+	if w.cb != nil {
+		w.cb(topic, payload)
+	}
+	return true
+}
+
+// Request publishes payload to topic with a freshly generated
+// correlation ID and a reply-to topic, then blocks until a matching
+// response arrives, ctx is cancelled, or the request times out.
+func (c *MqttV5Client) Request(ctx context.Context, topic string, payload []byte, opts ...RequestOption) (*Response, error) {
+	cfg := requestConfig{timeout: 30 * time.Second, qos: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.replyTopic == "" {
+		cfg.replyTopic = c.defaultReplyTopic()
+	}
+
+	correlationID := make([]byte, 8)
+	if _, err := rand.Read(correlationID); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	respCh := make(chan Response, 1)
+	c.correlation().m.Store(string(correlationID), &waiter{ch: respCh})
+	defer c.UnregisterCorrelated(correlationID)
+
+	if err := c.ensureSubscribedToReplyTopic(cfg.replyTopic, cfg.qos); err != nil {
+		return nil, err
+	}
+
+	props := paho.NewProperties().SetCorrelationData(correlationID).SetReplyTopic(cfg.replyTopic)
+	if _, err := c.Publish(topic, cfg.qos, payload, props); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-respCh:
+		return &resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.end():
+		return nil, errors.New("disconnected while awaiting response")
+	}
+}
+
+// ensureSubscribedToReplyTopic subscribes to replyTopic the first time
+// Request is asked to use it, guarding subscribedReplyTopics since
+// concurrent Request calls may race to subscribe to the same topic.
+func (c *MqttV5Client) ensureSubscribedToReplyTopic(replyTopic string, qos byte) error {
+	c.replyTopicsMu.Lock()
+	defer c.replyTopicsMu.Unlock()
+
+	if c.subscribedReplyTopics[replyTopic] {
+		return nil
+	}
+	if _, err := c.Subscribe([]packets.TopicQOSTuple{{Topic: replyTopic, Qos: qos}}, nil); err != nil {
+		return err
+	}
+	c.subscribedReplyTopics[replyTopic] = true
+	return nil
+}
+
+// defaultReplyTopic derives the topic a responder should publish its
+// answer to, preferring the server-advertised ResponseInfo prefix from
+// CONNACK over a client-ID-scoped fallback.
+func (c *MqttV5Client) defaultReplyTopic() string {
+	if props := c.SvrProps(); props != nil && props.ResponseInfo != "" {
+		return props.ResponseInfo + "/" + c.options.clientId
+	}
+	return c.options.clientId + "/response"
+}
+
+// end returns the channel Connect creates and readLoop closes on
+// disconnect, so in-flight requests can give up instead of blocking
+// forever. It must not be created lazily here: if nothing had called
+// end() yet by the time the connection dropped, readLoop would find
+// c.done nil, skip the close, and every call to end() afterwards would
+// hand out a fresh channel that nothing will ever close.
+func (c *MqttV5Client) end() <-chan struct{} {
+	c.RLock()
+	defer c.RUnlock()
+	return c.done
+}
+
+// Listen registers fallback to receive unsolicited PUBLISH packets that
+// don't match a correlation waiter, then blocks until the connection
+// closes. The actual read loop is started internally by Connect, since
+// it also has to service acks for Publish/Subscribe/Unsubscribe; Listen
+// exists so callers keep a familiar "run this in its own goroutine"
+// entry point for installing their fallback handler.
+func (c *MqttV5Client) Listen(fallback MessageHandler) {
+	c.Lock()
+	c.fallback = fallback
+	c.Unlock()
+
+	<-c.end()
+}
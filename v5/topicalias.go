@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package v5
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/paho"
+)
+
+// ErrProtocolViolation is returned when the peer used a topic alias
+// outside the range it agreed to in CONNECT/CONNACK.
+var ErrProtocolViolation = errors.New("topic alias protocol violation")
+
+// TopicAliasCache assigns short numeric aliases to outbound topic
+// strings so that repeated publishes to the same topic can omit the
+// topic name after the first message. It is bounded by max (typically
+// the peer's advertised TopicAliasMaximum from CONNACK) and evicts the
+// least recently used alias when full.
+type TopicAliasCache struct {
+	mu      sync.Mutex
+	max     uint16
+	next    uint16
+	byTopic map[string]*list.Element
+	order   *list.List // most-recently-used at the front
+}
+
+type aliasEntry struct {
+	topic string
+	alias uint16
+}
+
+// NewTopicAliasCache creates a TopicAliasCache that will hand out
+// aliases in the range [1, max]. A max of 0 disables aliasing entirely.
+func NewTopicAliasCache(max uint16) *TopicAliasCache {
+	return &TopicAliasCache{
+		max:     max,
+		byTopic: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// aliasFor returns the alias to use for topic and whether the full topic
+// string must still be sent alongside it. If topic already has an
+// alias, the empty topic string is intended to be sent with the alias
+// instead of the topic name.
+func (t *TopicAliasCache) aliasFor(topic string) (alias uint16, isNew bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.max == 0 {
+		return 0, false
+	}
+
+	if el, ok := t.byTopic[topic]; ok {
+		t.order.MoveToFront(el)
+		return el.Value.(*aliasEntry).alias, false
+	}
+
+	var a uint16
+	if t.next < t.max {
+		t.next++
+		a = t.next
+	} else {
+		// Evict the least recently used alias and reuse its number.
+		lru := t.order.Back()
+		entry := lru.Value.(*aliasEntry)
+		a = entry.alias
+		delete(t.byTopic, entry.topic)
+		t.order.Remove(lru)
+	}
+
+	el := t.order.PushFront(&aliasEntry{topic: topic, alias: a})
+	t.byTopic[topic] = el
+	return a, true
+}
+
+// InboundAliasTable resolves incoming topic aliases back to the full
+// topic string that established them, and enforces the alias maximum we
+// advertised to the peer in our own CONNECT.
+type InboundAliasTable struct {
+	mu     sync.Mutex
+	max    uint16
+	topics map[uint16]string
+}
+
+// NewInboundAliasTable creates an InboundAliasTable that will accept
+// aliases in the range [1, max], matching the TopicAliasMaximum we sent
+// in CONNECT.
+func NewInboundAliasTable(max uint16) *InboundAliasTable {
+	return &InboundAliasTable{
+		max:    max,
+		topics: make(map[uint16]string),
+	}
+}
+
+// Resolve returns the topic name a PUBLISH should be dispatched under,
+// recording topic against alias when topic is non-empty. It returns
+// ErrProtocolViolation if alias is 0, exceeds max, or an empty topic is
+// given for an alias that has never been established.
+func (t *InboundAliasTable) Resolve(topic string, alias uint16) (string, error) {
+	if alias == 0 || alias > t.max {
+		return "", ErrProtocolViolation
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if topic != "" {
+		t.topics[alias] = topic
+		return topic, nil
+	}
+	resolved, ok := t.topics[alias]
+	if !ok {
+		return "", ErrProtocolViolation
+	}
+	return resolved, nil
+}
+
+// PublishAliased publishes payload to topic at qos, using c's
+// TopicAliasCache to send either the topic string with a freshly
+// assigned alias, or an empty topic name with a previously assigned
+// alias. If the peer advertised a TopicAliasMaximum of 0, or c has not
+// connected yet, it behaves exactly like Publish.
+func (c *MqttV5Client) PublishAliased(topic string, qos byte, payload []byte) (packets.ReasonCode, error) {
+	if c.aliases == nil {
+		return c.Publish(topic, qos, payload, nil)
+	}
+
+	alias, isNew := c.aliases.aliasFor(topic)
+	if alias == 0 {
+		return c.Publish(topic, qos, payload, nil)
+	}
+
+	props := paho.NewProperties().SetTopicAlias(alias)
+	sendTopic := topic
+	if !isNew {
+		sendTopic = ""
+	}
+	return c.Publish(sendTopic, qos, payload, props)
+}
+
+// resolveInboundTopic resolves the topic a PUBLISH should be dispatched
+// under, disconnecting with reason code 0x94 (Topic Alias Invalid) on
+// protocol violations.
+func (c *MqttV5Client) resolveInboundTopic(topic string, props *paho.Properties) (string, error) {
+	if c.inboundAliases == nil || props == nil || props.TopicAlias == nil {
+		if topic == "" {
+			return "", ErrProtocolViolation
+		}
+		return topic, nil
+	}
+
+	resolved, err := c.inboundAliases.Resolve(topic, *props.TopicAlias)
+	if err != nil {
+		c.disconnect(packets.ReasonCodeTopicAliasInvalid, nil)
+		return "", err
+	}
+	return resolved, nil
+}
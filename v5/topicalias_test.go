@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package v5
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTopicAliasCacheReusesAssignedAlias(t *testing.T) {
+	c := NewTopicAliasCache(2)
+
+	alias, isNew := c.aliasFor("a")
+	if alias != 1 || !isNew {
+		t.Fatalf("aliasFor(a) = (%d, %v), want (1, true)", alias, isNew)
+	}
+
+	alias, isNew = c.aliasFor("a")
+	if alias != 1 || isNew {
+		t.Fatalf("aliasFor(a) again = (%d, %v), want (1, false)", alias, isNew)
+	}
+}
+
+func TestTopicAliasCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewTopicAliasCache(2)
+
+	c.aliasFor("a") // alias 1
+	c.aliasFor("b") // alias 2
+	c.aliasFor("a") // touch a, so b is now least recently used
+
+	alias, isNew := c.aliasFor("c")
+	if !isNew {
+		t.Fatalf("aliasFor(c) isNew = false, want true")
+	}
+	if alias != 2 {
+		t.Fatalf("aliasFor(c) reused alias %d, want b's alias 2", alias)
+	}
+
+	if _, isNew := c.aliasFor("b"); !isNew {
+		t.Fatalf("b should have been evicted and need a fresh alias")
+	}
+}
+
+func TestTopicAliasCacheDisabledWhenMaxZero(t *testing.T) {
+	c := NewTopicAliasCache(0)
+
+	alias, isNew := c.aliasFor("a")
+	if alias != 0 || isNew {
+		t.Fatalf("aliasFor with max=0 = (%d, %v), want (0, false)", alias, isNew)
+	}
+}
+
+func TestTopicAliasCacheConcurrentUse(t *testing.T) {
+	c := NewTopicAliasCache(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.aliasFor("shared-topic")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInboundAliasTableResolve(t *testing.T) {
+	tbl := NewInboundAliasTable(2)
+
+	resolved, err := tbl.Resolve("a/b", 1)
+	if err != nil || resolved != "a/b" {
+		t.Fatalf("Resolve(a/b, 1) = (%q, %v), want (a/b, nil)", resolved, err)
+	}
+
+	resolved, err = tbl.Resolve("", 1)
+	if err != nil || resolved != "a/b" {
+		t.Fatalf("Resolve(\"\", 1) = (%q, %v), want (a/b, nil)", resolved, err)
+	}
+}
+
+func TestInboundAliasTableRejectsOutOfRangeAlias(t *testing.T) {
+	tbl := NewInboundAliasTable(2)
+
+	if _, err := tbl.Resolve("a/b", 3); err != ErrProtocolViolation {
+		t.Fatalf("Resolve with alias exceeding max = %v, want ErrProtocolViolation", err)
+	}
+	if _, err := tbl.Resolve("", 1); err != ErrProtocolViolation {
+		t.Fatalf("Resolve(\"\", never-established alias) = %v, want ErrProtocolViolation", err)
+	}
+	if _, err := tbl.Resolve("", 0); err != ErrProtocolViolation {
+		t.Fatalf("Resolve(\"\", 0) = %v, want ErrProtocolViolation", err)
+	}
+}
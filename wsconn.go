@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2013 IBM Corp.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ *
+ * Contributors:
+ *    Seth Hoenig
+ *    Allan Stockdill-Mander
+ *    Mike Robertson
+ */
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn adapts a *websocket.Conn to the net.Conn interface so that the
+// existing bufio.ReadWriter and the outgoing/incoming goroutines can
+// treat a WebSocket connection exactly like a TCP one. The MQTT byte
+// stream is carried in binary WebSocket messages, reassembling
+// fragmented frames into a single contiguous read buffer as required by
+// the MQTT-over-WebSocket binding.
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+}
+
+func newWsConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.reader == nil {
+		_, r, err := c.ws.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		c.reader = r
+	}
+
+	n, err := c.reader.Read(b)
+	if err == io.EOF {
+		// This WebSocket message is exhausted; fetch the next frame
+		// (possibly fragmented across several) on the following Read.
+		c.reader = nil
+		if n > 0 {
+			return n, nil
+		}
+		return c.Read(b)
+	}
+	return n, err
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }